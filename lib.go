@@ -8,6 +8,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
 )
 
 // *** Hash Functions ***
@@ -21,23 +22,32 @@ func key2path(key []byte) string {
 	return fmt.Sprintf("/%02x/%02x/%s", mkey[0], mkey[1], b64key)
 }
 
-func key2volume(key []byte, volumes []string) string {
-	// this is an intelligent way to pick the volume server for a file
-	// stable in the volume server name (not position!)
-	// and if more are added the correct portion will move (yay md5!)
-	var bestScore []byte
-	var ret string
-	for _, v := range volumes {
+func key2volumes(key []byte, volumes []string, n int) []string {
+	// rendezvous (HRW) hashing: score every volume for this key and take
+	// the top n, stable in the volume server name (not position!)
+	// and if more are added only the correct portion will move (yay md5!)
+	type scoredVolume struct {
+		volume string
+		score  []byte
+	}
+	scored := make([]scoredVolume, len(volumes))
+	for i, v := range volumes {
 		hash := md5.New()
 		hash.Write(key)
 		hash.Write([]byte(v))
-		score := hash.Sum(nil)
-		if bestScore == nil || bytes.Compare(bestScore, score) == -1 {
-			bestScore = score
-			ret = v
-		}
+		scored[i] = scoredVolume{v, hash.Sum(nil)}
+	}
+	sort.Slice(scored, func(i, j int) bool {
+		return bytes.Compare(scored[i].score, scored[j].score) == 1
+	})
+	if n > len(scored) {
+		n = len(scored)
 	}
-	//fmt.Println(string(key), ret, bestScore)
+	ret := make([]string, n)
+	for i := 0; i < n; i++ {
+		ret[i] = scored[i].volume
+	}
+	//fmt.Println(string(key), ret)
 	return ret
 }
 
@@ -77,6 +87,27 @@ func remote_put(remote string, length int64, body io.Reader) error {
 	return nil
 }
 
+func remote_head(remote string) bool {
+	resp, err := http.Head(remote)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == 200
+}
+
+func remote_copy(src, dst string) error {
+	resp, err := http.Get(src)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("remote_copy: wrong status code %d", resp.StatusCode)
+	}
+	return remote_put(dst, resp.ContentLength, resp.Body)
+}
+
 func remote_get(remote string) (string, error) {
 	resp, err := http.Get(remote)
 	if err != nil {
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// *** Key Metadata ***
+//
+// Each leveldb value used to be just a comma-separated volume list. It's
+// now a small JSON record carrying the replica set plus the integrity
+// metadata computed on PUT. decodeMeta understands both: a value that
+// doesn't parse as KeyMeta JSON is treated as a legacy plain volume list
+// with no MD5/size/ctime, so old entries keep working as they are; a
+// rebalance that moves such a key rewrites its value in the JSON form.
+type KeyMeta struct {
+	Volumes []string `json:"volumes"`
+	MD5     string   `json:"md5,omitempty"`
+	Size    int64    `json:"size,omitempty"`
+	CTime   int64    `json:"ctime,omitempty"` // unix seconds
+}
+
+func decodeMeta(data []byte) KeyMeta {
+	var meta KeyMeta
+	if err := json.Unmarshal(data, &meta); err == nil && len(meta.Volumes) > 0 {
+		return meta
+	}
+	return KeyMeta{Volumes: strings.Split(string(data), ",")}
+}
+
+func (m KeyMeta) encode() ([]byte, error) {
+	return json.Marshal(m)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// *** Metrics & Structured Logging ***
+
+type Metrics struct {
+	requestsTotal   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	remoteDuration  *prometheus.HistogramVec
+	remoteErrors    *prometheus.CounterVec
+	leveldbDuration *prometheus.HistogramVec
+	activeLocks     prometheus.Gauge
+	volumeRequests  *prometheus.CounterVec
+}
+
+func NewMetrics(reg *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mkv_requests_total",
+			Help: "Total master requests by method and status",
+		}, []string{"method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "mkv_request_duration_seconds",
+			Help: "PUT/GET/DELETE latency as seen by the master",
+		}, []string{"method"}),
+		remoteDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "mkv_remote_duration_seconds",
+			Help: "remote_put/head/delete/copy latency against volume servers",
+		}, []string{"op"}),
+		remoteErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mkv_remote_errors_total",
+			Help: "remote_put/head/delete/copy errors against volume servers",
+		}, []string{"op"}),
+		leveldbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "mkv_leveldb_duration_seconds",
+			Help: "leveldb operation timings",
+		}, []string{"op"}),
+		activeLocks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mkv_active_key_locks",
+			Help: "number of keys currently locked for an in-flight PUT/DELETE or rebalance",
+		}),
+		volumeRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mkv_volume_requests_total",
+			Help: "requests sent to each volume server",
+		}, []string{"volume"}),
+	}
+	reg.MustRegister(m.requestsTotal, m.requestDuration, m.remoteDuration,
+		m.remoteErrors, m.leveldbDuration, m.activeLocks, m.volumeRequests)
+	return m
+}
+
+// volumeFromRemote pulls the host:port out of a remote URL for labeling.
+func volumeFromRemote(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return "unknown"
+	}
+	return u.Host
+}
+
+// *** Instrumented leveldb helpers ***
+
+func (a *App) dbGet(key []byte) ([]byte, error) {
+	start := time.Now()
+	val, err := a.db.Get(key, nil)
+	a.metrics.leveldbDuration.WithLabelValues("get").Observe(time.Since(start).Seconds())
+	return val, err
+}
+
+func (a *App) dbPut(key, value []byte) error {
+	start := time.Now()
+	err := a.db.Put(key, value, nil)
+	a.metrics.leveldbDuration.WithLabelValues("put").Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (a *App) dbDelete(key []byte) error {
+	start := time.Now()
+	err := a.db.Delete(key, nil)
+	a.metrics.leveldbDuration.WithLabelValues("delete").Observe(time.Since(start).Seconds())
+	return err
+}
+
+// *** Instrumented remote helpers ***
+
+func (a *App) remotePut(remote string, length int64, body io.Reader) error {
+	start := time.Now()
+	err := remote_put(remote, length, body)
+	a.metrics.remoteDuration.WithLabelValues("put").Observe(time.Since(start).Seconds())
+	a.metrics.volumeRequests.WithLabelValues(volumeFromRemote(remote)).Inc()
+	if err != nil {
+		a.metrics.remoteErrors.WithLabelValues("put").Inc()
+	}
+	return err
+}
+
+func (a *App) remoteDelete(remote string) error {
+	start := time.Now()
+	err := remote_delete(remote)
+	a.metrics.remoteDuration.WithLabelValues("delete").Observe(time.Since(start).Seconds())
+	a.metrics.volumeRequests.WithLabelValues(volumeFromRemote(remote)).Inc()
+	if err != nil {
+		a.metrics.remoteErrors.WithLabelValues("delete").Inc()
+	}
+	return err
+}
+
+func (a *App) remoteHead(remote string) bool {
+	start := time.Now()
+	ok := remote_head(remote)
+	a.metrics.remoteDuration.WithLabelValues("head").Observe(time.Since(start).Seconds())
+	a.metrics.volumeRequests.WithLabelValues(volumeFromRemote(remote)).Inc()
+	if !ok {
+		a.metrics.remoteErrors.WithLabelValues("head").Inc()
+	}
+	return ok
+}
+
+func (a *App) remoteCopy(src, dst string) error {
+	start := time.Now()
+	err := remote_copy(src, dst)
+	a.metrics.remoteDuration.WithLabelValues("copy").Observe(time.Since(start).Seconds())
+	a.metrics.volumeRequests.WithLabelValues(volumeFromRemote(dst)).Inc()
+	if err != nil {
+		a.metrics.remoteErrors.WithLabelValues("copy").Inc()
+	}
+	return err
+}
+
+// *** Request logging context ***
+
+type requestInfo struct {
+	volume   string
+	replicas int
+}
+
+type ctxKey int
+
+const requestInfoKey ctxKey = 0
+
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)), info
+}
+
+func requestInfoFromContext(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// statusRecorder captures the status code written by the wrapped handler,
+// since http.ResponseWriter doesn't expose it after the fact.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets statusRecorder satisfy http.Flusher by delegating to the
+// wrapped ResponseWriter, so handlers that stream incremental output (e.g.
+// ListQueryHandler's NDJSON mode) still flush when running behind this
+// middleware.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the wrapped ResponseWriter so http.ResponseController (and
+// other callers using the standard unwrap convention) can reach interfaces
+// statusRecorder doesn't itself implement.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// MetricsMiddleware records request metrics and emits a structured access
+// log line for every request, then hands off to next.
+func MetricsMiddleware(m *Metrics, logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rWithInfo, info := withRequestInfo(r)
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+
+		next.ServeHTTP(rec, rWithInfo)
+
+		elapsed := time.Since(start)
+		m.requestsTotal.WithLabelValues(r.Method, strconv.Itoa(rec.status)).Inc()
+		m.requestDuration.WithLabelValues(r.Method).Observe(elapsed.Seconds())
+
+		logger.Info("request",
+			"method", r.Method,
+			"key", r.URL.Path,
+			"status", rec.status,
+			"volume", info.volume,
+			"replicas", info.replicas,
+			"duration_ms", elapsed.Milliseconds(),
+		)
+	})
+}
+
+// MetricsHandler exposes the Prometheus registry at /metrics.
+func MetricsHandler(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// *** Rebalance Work Queue ***
+//
+// When a GET finds a key stored on the wrong volumes (because -volumes
+// changed, or a replica write only partially succeeded) it enqueues the
+// key here instead of blocking the response. A background worker pool
+// drains the queue, streaming the object to its correct volumes and
+// updating leveldb once the copy lands.
+
+type WorkQueue struct {
+	mu      sync.Mutex
+	pending map[string]struct{}
+	items   chan string
+}
+
+func NewWorkQueue(capacity int) *WorkQueue {
+	return &WorkQueue{
+		pending: make(map[string]struct{}),
+		items:   make(chan string, capacity),
+	}
+}
+
+// Enqueue adds key to the queue. It returns false if key is already
+// queued (dedup) or the queue is full, in which case the caller should
+// just drop it -- a future GET or a full rescan will pick it up again.
+func (q *WorkQueue) Enqueue(key []byte) bool {
+	q.mu.Lock()
+	if _, prs := q.pending[string(key)]; prs {
+		q.mu.Unlock()
+		return false
+	}
+	q.pending[string(key)] = struct{}{}
+	q.mu.Unlock()
+
+	select {
+	case q.items <- string(key):
+		return true
+	default:
+		q.mu.Lock()
+		delete(q.pending, string(key))
+		q.mu.Unlock()
+		return false
+	}
+}
+
+func (q *WorkQueue) dequeue() (string, bool) {
+	key, ok := <-q.items
+	if !ok {
+		return "", false
+	}
+	q.mu.Lock()
+	delete(q.pending, key)
+	q.mu.Unlock()
+	return key, true
+}
+
+func (q *WorkQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// StartRebalanceWorkers launches n goroutines that drain a.queue until
+// the process exits.
+func (a *App) StartRebalanceWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go a.rebalanceWorker()
+	}
+}
+
+func (a *App) rebalanceWorker() {
+	for {
+		key, ok := a.queue.dequeue()
+		if !ok {
+			return
+		}
+		a.rebalanceKey([]byte(key))
+	}
+}
+
+// rebalanceKey moves key onto the volumes key2volumes currently picks for
+// it, copying from a live replica and only dropping the stale replicas
+// once leveldb reflects the new set.
+func (a *App) rebalanceKey(key []byte) {
+	data, err := a.dbGet(key)
+	if err != nil {
+		return // key was deleted out from under us, nothing to do
+	}
+	meta := decodeMeta(data)
+	have := meta.Volumes
+	want := key2volumes(key, a.volumes, len(have))
+	if sameVolumes(have, want) {
+		return // already settled, raced with another enqueue
+	}
+
+	if !a.LockKey(key) {
+		// a PUT/DELETE is in flight for this key, try again later
+		a.queue.Enqueue(key)
+		return
+	}
+	defer a.UnlockKey(key)
+
+	path := key2path(key)
+	haveSet := volumeSet(have)
+	wantSet := volumeSet(want)
+
+	var src string
+	for _, v := range have {
+		candidate := fmt.Sprintf("http://%s%s", v, path)
+		if a.remoteHead(candidate) {
+			src = candidate
+			break
+		}
+	}
+	if src == "" {
+		a.logger.Error("rebalance: no live replica, skipping", "key", string(key))
+		return
+	}
+
+	for _, v := range want {
+		if _, prs := haveSet[v]; prs {
+			continue
+		}
+		dst := fmt.Sprintf("http://%s%s", v, path)
+		if err := a.remoteCopy(src, dst); err != nil {
+			a.logger.Error("rebalance: copy failed", "key", string(key), "dst", v, "error", err)
+			return
+		}
+	}
+
+	meta.Volumes = want
+	encoded, err := meta.encode()
+	if err != nil {
+		a.logger.Error("rebalance: encoding metadata failed", "key", string(key), "error", err)
+		return
+	}
+	if err := a.dbPut(key, encoded); err != nil {
+		a.logger.Error("rebalance: leveldb update failed", "key", string(key), "error", err)
+		return
+	}
+
+	for _, v := range have {
+		if _, prs := wantSet[v]; !prs {
+			a.remoteDelete(fmt.Sprintf("http://%s%s", v, path))
+		}
+	}
+}
+
+// ScanForRebalance walks every key in leveldb and enqueues the ones that
+// aren't on the volumes key2volumes would currently pick. It's run once
+// on boot (so queued work survives a restart) and on a POST to
+// /rebalance.
+func (a *App) ScanForRebalance() {
+	iter := a.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		meta := decodeMeta(iter.Value())
+		if !sameVolumes(meta.Volumes, key2volumes(key, a.volumes, len(meta.Volumes))) {
+			a.queue.Enqueue(key)
+		}
+	}
+}
+
+// RebalanceHandler serves POST /rebalance (full scan), GET /rebalance
+// (queue depth) and POST /rebalance/{key}; GET /rebalance/{key} is a 404.
+func (a *App) RebalanceHandler(w http.ResponseWriter, r *http.Request) {
+	// keys are stored (and looked up) with their leading slash, so only
+	// the "/rebalance" prefix itself is stripped here -- don't also trim
+	// the "/" that starts the real key, or POST /rebalance/foo would
+	// enqueue "foo" instead of the "/foo" leveldb actually has
+	key := strings.TrimPrefix(r.URL.Path, "/rebalance")
+
+	switch r.Method {
+	case "POST":
+		if key == "" {
+			go a.ScanForRebalance()
+		} else {
+			a.queue.Enqueue([]byte(key))
+		}
+		w.WriteHeader(202)
+	case "GET":
+		if key != "" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, `{"depth": %d}`, a.queue.Len())
+	default:
+		w.WriteHeader(405)
+	}
+}
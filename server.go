@@ -1,13 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
@@ -15,16 +26,128 @@ import (
 // *** Master Server ***
 
 type App struct {
-	db      *leveldb.DB
-	mlock   sync.Mutex
-	lock    map[string]struct{}
-	volumes []string
+	db       *leveldb.DB
+	mlock    sync.Mutex
+	lock     map[string]struct{}
+	volumes  []string
+	replicas int // how many volumes each key is stored on
+	quorum   int // how many replicas must succeed for PUT/DELETE to commit
+	queue    *WorkQueue
+	metrics  *Metrics
+	metricsH http.Handler
+	proxy    bool // stream object bodies through the master instead of 302ing
+	logger   *slog.Logger
+}
+
+// these headers are forwarded verbatim between the client and the volume
+// server so Range / conditional GETs work in proxy mode.
+var proxyRequestHeaders = []string{"Range", "If-None-Match", "If-Match", "If-Modified-Since", "If-Unmodified-Since"}
+var proxyResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"}
+
+// proxyGet streams remote through to w instead of redirecting the client
+// to it, forwarding Range and conditional headers both ways so 206
+// Partial Content and 304 Not Modified work the same as talking to the
+// volume server directly. It reports whether remote was reachable at
+// all, so the caller can fail over to the next replica without having
+// written a response yet; a reachable-but-non-200 remote still counts
+// as handled (its status is forwarded as-is).
+func (a *App) proxyGet(remote string, w http.ResponseWriter, r *http.Request) bool {
+	req, err := http.NewRequest(r.Method, remote, nil)
+	if err != nil {
+		return false
+	}
+	for _, h := range proxyRequestHeaders {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	for _, h := range proxyResponseHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == "GET" {
+		io.Copy(w, resp.Body)
+	}
+	return true
+}
+
+// verifyGet fetches remote in full, recomputes its MD5, and only then
+// serves it to w -- returning a 502 instead of sending known-bad bytes if
+// the digest doesn't match what's stored for this key. This means
+// buffering the whole object, unlike proxyGet's streaming copy, but
+// ?verify=1 is opt-in precisely because it trades the streaming
+// optimization for an integrity guarantee the client can act on. It
+// returns false when remote is unreachable or answers with anything but
+// 200, so the caller fails over to the next replica; unlike proxyGet, a
+// non-200 status from the volume is not forwarded to the client.
+func (a *App) verifyGet(meta KeyMeta, remote string, w http.ResponseWriter, r *http.Request) bool {
+	resp, err := http.Get(remote)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return false
+	}
+
+	hash := md5.New()
+	body, err := ioutil.ReadAll(io.TeeReader(resp.Body, hash))
+	if err != nil {
+		w.WriteHeader(502)
+		return true
+	}
+	sum := hash.Sum(nil)
+	if meta.MD5 != "" && hex.EncodeToString(sum) != meta.MD5 {
+		a.logger.Error("verify: md5 mismatch", "remote", remote, "got", hex.EncodeToString(sum), "want", meta.MD5)
+		w.WriteHeader(502)
+		return true
+	}
+
+	// Content-MD5/ETag are already set by the caller (ServeHTTP sets them
+	// for every GET/HEAD of a key with a stored digest before dispatching here)
+	w.WriteHeader(200)
+	if r.Method == "GET" {
+		w.Write(body)
+	}
+	return true
+}
+
+func volumeSet(volumes []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(volumes))
+	for _, v := range volumes {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+// sameVolumes reports whether a and b contain the same volumes, ignoring order.
+func sameVolumes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	setA := volumeSet(a)
+	for _, v := range b {
+		if _, prs := setA[v]; !prs {
+			return false
+		}
+	}
+	return true
 }
 
 func (a *App) UnlockKey(key []byte) {
 	a.mlock.Lock()
 	delete(a.lock, string(key))
 	a.mlock.Unlock()
+	a.metrics.activeLocks.Dec()
 }
 
 func (a *App) LockKey(key []byte) bool {
@@ -34,46 +157,131 @@ func (a *App) LockKey(key []byte) bool {
 		return false
 	}
 	a.lock[string(key)] = struct{}{} // empty value, so no space is used. comvetion use of set for golang
+	a.metrics.activeLocks.Inc()
 	return true
 }
 
+// defaultListPageSize bounds the plain JSON listing mode when the caller
+// doesn't pass &limit=, so a single request can't buffer an unbounded
+// number of keys in memory. NDJSON mode has no such cap since it streams.
+const defaultListPageSize = 1000
+
+// ListQueryHandler serves ?list, with optional &start=, &limit= and
+// &format=ndjson|json. NDJSON streams one JSON-encoded key per line,
+// flushing periodically so arbitrarily large listings don't have to be
+// buffered. Plain JSON mode returns {keys, next}, where next is the first
+// key past this page (omitted when there is none) -- pass it back as
+// &start= to fetch the following page.
 func (a *App) ListQueryHandler(key []byte, w http.ResponseWriter, r *http.Request) {
-	switch r.URL.RawQuery {
-	case "list":
-		iter := a.db.NewIterator(util.BytesPrefix(key), nil)
-		defer iter.Release()
-		keys := make([]string, 0) // size = 0
+	query := r.URL.Query()
+
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			w.WriteHeader(400)
+			return
+		}
+		limit = n
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "ndjson" && format != "json" {
+		w.WriteHeader(400)
+		return
+	}
+	if format == "json" && limit == 0 {
+		limit = defaultListPageSize
+	}
+
+	krange := util.BytesPrefix(key)
+	if start := query.Get("start"); start != "" {
+		krange.Start = []byte(start)
+	}
+	iter := a.db.NewIterator(krange, nil)
+	defer iter.Release()
+
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(200)
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		count := 0
 		for iter.Next() {
-			keys = append(keys, string(iter.Key()))
-			if len(keys) > 1000000 { // too large
-				w.WriteHeader(413)
+			if limit > 0 && count >= limit {
+				break
+			}
+			if err := enc.Encode(string(iter.Key())); err != nil {
 				return
 			}
+			count++
+			if flusher != nil && count%1000 == 0 {
+				flusher.Flush()
+			}
 		}
-		str, err := json.Marshal(keys)
-		if err != nil {
-			w.WriteHeader(500)
-			return
+		if flusher != nil {
+			flusher.Flush()
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(200)
-		w.Write(str)
 		return
-	default:
-		w.WriteHeader(403)
+	}
+
+	keys := make([]string, 0)
+	var next string
+	for iter.Next() {
+		if len(keys) >= limit {
+			next = string(iter.Key())
+			break
+		}
+		keys = append(keys, string(iter.Key()))
+	}
+
+	str, err := json.Marshal(struct {
+		Keys []string `json:"keys"`
+		Next string   `json:"next,omitempty"`
+	}{keys, next})
+	if err != nil {
+		w.WriteHeader(500)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(str)
 }
 
+// /metrics and /rebalance(/...) are a reserved admin namespace -- keys
+// under them can't be stored as objects. /rebalance also serves
+// /rebalance/{key} for triggering a single key's rebalance, so it's
+// matched on the "/rebalance/" prefix (plus the bare "/rebalance" path)
+// rather than a plain HasPrefix, which would otherwise also swallow an
+// unrelated object key like "/rebalancefoo".
 func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metrics" {
+		a.metricsH.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/rebalance" || strings.HasPrefix(r.URL.Path, "/rebalance/") {
+		a.RebalanceHandler(w, r)
+		return
+	}
 	key := []byte(r.URL.Path)
 	if len(r.URL.RawQuery) > 0 {
-		if r.Method != "GET" {
+		if _, isList := r.URL.Query()["list"]; isList {
+			if r.Method != "GET" {
+				w.WriteHeader(403)
+				return
+			}
+			a.ListQueryHandler(key, w, r)
+			return
+		}
+		// other query params (e.g. ?proxy=1) are handled by the normal
+		// GET/HEAD case below, which inspects r.URL.Query() itself
+		if r.Method != "GET" && r.Method != "HEAD" {
 			w.WriteHeader(403)
 			return
 		}
-		a.ListQueryHandler(key, w, r)
-		return
 	}
 	// lock the key while a PUT or DELETE is in progress
 	if r.Method == "PUT" || r.Method == "DELETE" {
@@ -85,9 +293,11 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		defer a.UnlockKey(key)
 	}
 
+	info := requestInfoFromContext(r)
+
 	switch r.Method {
 	case "GET", "HEAD":
-		kvolume, err := a.db.Get(key, nil)
+		raw, err := a.dbGet(key)
 		if err == leveldb.ErrNotFound {
 			// manually setting content length is required for HEAD (but shouldn't need to be in 404 case)
 			// https://github.com/golang/go/blob/88548d0211ba64896fa76a5d1818e4422847a879/src/net/http/server.go#L1256
@@ -95,11 +305,64 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(404)
 			return
 		}
-		volume := string(kvolume)
-		if volume != key2volume(key, a.volumes) {
-			fmt.Println("on wrong volume, needs rebalance")
+		meta := decodeMeta(raw)
+		info.replicas = len(meta.Volumes)
+		if !sameVolumes(meta.Volumes, key2volumes(key, a.volumes, len(meta.Volumes))) {
+			// opportunistic, doesn't block the response
+			a.queue.Enqueue(key)
 		}
-		remote := fmt.Sprintf("http://%s%s", volume, key2path(key))
+
+		if meta.MD5 != "" {
+			sum, _ := hex.DecodeString(meta.MD5)
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+			w.Header().Set("ETag", fmt.Sprintf("%q", meta.MD5))
+		}
+
+		verify := r.URL.Query().Get("verify") == "1"
+		proxying := verify || a.proxy || r.URL.Query().Get("proxy") == "1"
+
+		if proxying {
+			// the GET/verify attempt against each replica is itself the
+			// liveness probe, so there's no separate HEAD round trip here
+			for _, volume := range meta.Volumes {
+				remote := fmt.Sprintf("http://%s%s", volume, key2path(key))
+				var reached bool
+				if verify {
+					reached = a.verifyGet(meta, remote, w, r)
+				} else {
+					reached = a.proxyGet(remote, w, r)
+				}
+				if reached {
+					info.volume = remote
+					return
+				}
+			}
+			w.WriteHeader(502)
+			return
+		}
+
+		// redirect mode: with a single replica there's nothing to fail
+		// over to, so skip the probe and hand back a 302 unconditionally,
+		// same as before replication existed. With more than one replica,
+		// HEAD each in turn and redirect to the first one that's alive.
+		var remote string
+		if len(meta.Volumes) == 1 {
+			remote = fmt.Sprintf("http://%s%s", meta.Volumes[0], key2path(key))
+		} else {
+			for _, volume := range meta.Volumes {
+				candidate := fmt.Sprintf("http://%s%s", volume, key2path(key))
+				if a.remoteHead(candidate) {
+					remote = candidate
+					break
+				}
+			}
+		}
+		if remote == "" {
+			w.WriteHeader(502)
+			return
+		}
+		info.volume = remote
+
 		w.Header().Set("Location", remote)
 		// manually setting content length is required for HEAD (but shouldn't need to be in 302 case)
 		// https://github.com/golang/go/blob/88548d0211ba64896fa76a5d1818e4422847a879/src/net/http/server.go#L1256
@@ -112,7 +375,7 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		_, err := a.db.Get(key, nil)
+		_, err := a.dbGet(key)
 		// check if we already have the key
 		if err != leveldb.ErrNotFound {
 			// Forbidden to overwrite with PUT
@@ -120,20 +383,87 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// we don't, compute the remote URL
-		kvolume := key2volume(key, a.volumes)
-		remote := fmt.Sprintf("http://%s%s", kvolume, key2path(key))
-		// fmt.Printf("remote: %s\n", remote)
+		// r.Body can only be read once, but we need to send it to every
+		// replica, so buffer it up front, teeing through md5 as we go
+		hash := md5.New()
+		body, err := ioutil.ReadAll(io.TeeReader(r.Body, hash))
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		sum := hash.Sum(nil)
+
+		// we don't have the key yet, compute the replica set
+		kvolumes := key2volumes(key, a.volumes, a.replicas)
+		info.replicas = len(kvolumes)
+		remotes := make([]string, len(kvolumes))
+		for i, v := range kvolumes {
+			remotes[i] = fmt.Sprintf("http://%s%s", v, key2path(key))
+		}
+
+		ok := make([]bool, len(remotes))
+		var wg sync.WaitGroup
+		for i, remote := range remotes {
+			wg.Add(1)
+			go func(i int, remote string) {
+				defer wg.Done()
+				if a.remotePut(remote, r.ContentLength, bytes.NewReader(body)) == nil {
+					ok[i] = true
+				}
+			}(i, remote)
+		}
+		wg.Wait()
+
+		var succeeded []string
+		for i, good := range ok {
+			if good {
+				succeeded = append(succeeded, kvolumes[i])
+			}
+		}
+
+		if len(succeeded) < a.quorum {
+			// didn't reach write quorum, clean up the partial replicas
+			for i, good := range ok {
+				if good {
+					a.remoteDelete(remotes[i])
+				}
+			}
+			w.WriteHeader(500)
+			return
+		}
+		info.volume = strings.Join(succeeded, ",")
+
+		// honor an incoming Content-MD5 (RFC 1864, base64): it is compared
+		// with the digest computed above only after the upload has landed,
+		// so on a mismatch the replicas just written are deleted again
+		if cmd5 := r.Header.Get("Content-MD5"); cmd5 != "" {
+			decoded, err := base64.StdEncoding.DecodeString(cmd5)
+			if err != nil || !bytes.Equal(decoded, sum) {
+				for i, good := range ok {
+					if good {
+						a.remoteDelete(remotes[i])
+					}
+				}
+				w.WriteHeader(400)
+				return
+			}
+		}
 
-		if remote_put(remote, r.ContentLength, r.Body) != nil {
-			// we assume the remote wrote nothing if it failed
+		meta := KeyMeta{
+			Volumes: succeeded,
+			MD5:     hex.EncodeToString(sum),
+			Size:    r.ContentLength,
+			CTime:   time.Now().Unix(),
+		}
+		encoded, err := meta.encode()
+		if err != nil {
 			w.WriteHeader(500)
 			return
 		}
 
-		// push only kvolume to leveldb
+		// push the replicas and integrity metadata to leveldb
 		// note that the key is locked, so nobody wrote to the leveldb
-		if err := a.db.Put(key, []byte(kvolume), nil); err != nil {
+		if err := a.dbPut(key, encoded); err != nil {
 			// should we delete?
 			w.WriteHeader(500)
 			return
@@ -142,41 +472,98 @@ func (a *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// 201, all good
 		w.WriteHeader(201)
 	case "DELETE":
-		// delete the key, first locally
-		data, err := a.db.Get(key, nil)
+		data, err := a.dbGet(key)
 		if err == leveldb.ErrNotFound {
 			w.WriteHeader(404)
 			return
 		}
 
-		a.db.Delete(key, nil)
+		// fan the delete out across all replicas first, and only drop the
+		// leveldb record once quorum of them confirm -- if we deleted the
+		// record up front and then failed quorum, the key would be gone
+		// with no way to retry and no way to find the orphaned remotes
+		meta := decodeMeta(data)
+		info.volume = strings.Join(meta.Volumes, ",")
+		info.replicas = len(meta.Volumes)
+		ok := make([]bool, len(meta.Volumes))
+		var wg sync.WaitGroup
+		for i, volume := range meta.Volumes {
+			wg.Add(1)
+			go func(i int, volume string) {
+				defer wg.Done()
+				remote := fmt.Sprintf("http://%s%s", volume, key2path(key))
+				if a.remoteDelete(remote) == nil {
+					ok[i] = true
+				}
+			}(i, volume)
+		}
+		wg.Wait()
 
-		// then remotely
-		remote := fmt.Sprintf("http://%s%s", string(data), key2path(key))
-		if remote_delete(remote) != nil {
-			// if this fails, it's possible to get an orphan file
-			// but i'm not really sure what else to do?
+		succeeded := 0
+		for _, good := range ok {
+			if good {
+				succeeded++
+			}
+		}
+		// a key with fewer replicas than the configured quorum (e.g. a
+		// legacy entry, or one written while -quorum was lower) can never
+		// reach quorum -- that's
+		// still a hard failure, but at least the record is left in place
+		// to retry rather than destroyed on a doomed attempt
+		if succeeded < a.quorum {
 			w.WriteHeader(500)
 			return
 		}
 
+		a.dbDelete(key)
+
 		// 204, all good
 		w.WriteHeader(204)
 	}
 }
 
 func main() {
-	fmt.Printf("hello from go %s\n", os.Args[3])
+	dir := flag.String("dir", "", "the directory for the leveldb")
+	port := flag.String("port", "3000", "the port to listen on")
+	volumes := flag.String("volumes", "", "comma separated list of volume servers")
+	replicas := flag.Int("replicas", 1, "how many volume servers to store each key on")
+	quorum := flag.Int("quorum", 1, "how many replicas must succeed for a PUT/DELETE to commit")
+	rebalanceWorkers := flag.Int("rebalance-workers", 4, "how many goroutines drain the rebalance queue")
+	rebalanceQueueSize := flag.Int("rebalance-queue-size", 10000, "how many keys the rebalance queue can hold before new enqueues are dropped")
+	proxy := flag.Bool("proxy", false, "stream GET/HEAD bodies through the master instead of redirecting to the volume")
+	flag.Parse()
+
+	if *replicas < *quorum {
+		fmt.Println(fmt.Errorf("quorum (%d) cannot be larger than replicas (%d)", *quorum, *replicas))
+		return
+	}
+
+	fmt.Printf("hello from go %s\n", *volumes)
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 100
 
-	db, err := leveldb.OpenFile(os.Args[1], nil)
+	db, err := leveldb.OpenFile(*dir, nil)
 	if err != nil {
 		fmt.Println(fmt.Errorf("LevelDB open failed %s", err))
 		return
 	}
 	defer db.Close()
 
-	http.ListenAndServe(":"+os.Args[2], &App{db: db,
-		lock:    make(map[string]struct{}),
-		volumes: strings.Split(os.Args[3], ",")})
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry)
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	app := &App{db: db,
+		lock:     make(map[string]struct{}),
+		volumes:  strings.Split(*volumes, ","),
+		replicas: *replicas,
+		quorum:   *quorum,
+		queue:    NewWorkQueue(*rebalanceQueueSize),
+		metrics:  metrics,
+		metricsH: MetricsHandler(registry),
+		proxy:    *proxy,
+		logger:   logger}
+	app.StartRebalanceWorkers(*rebalanceWorkers)
+	go app.ScanForRebalance() // survive restarts by re-scanning on boot
+
+	http.ListenAndServe(":"+*port, MetricsMiddleware(metrics, logger, app))
 }